@@ -1,58 +1,1238 @@
 package main
 
 import (
+    "bufio"
     "bytes"
+    "crypto/sha256"
+    "encoding/csv"
     "encoding/json"
     "fmt"
     "io/ioutil"
+    "math/rand"
     "net/http"
+    "sort"
     "strings"
     "os"
     "strconv"
+    "sync"
     "time"
+
+    "github.com/NVIDIA/go-nvml/pkg/nvml"
+    "github.com/dustin/go-humanize"
+    "github.com/shirou/gopsutil/v3/cpu"
+    "github.com/shirou/gopsutil/v3/load"
+    "github.com/shirou/gopsutil/v3/mem"
 )
 
-type Result struct {
-    duration    time.Duration
-    totalTokens int
-    err         error
+// liveStats accumulates cumulative request counters as makeRequest completes
+// requests, independent of which prompt or load-gen mode is running, so the
+// live reporter goroutine started in main can print deltas over each
+// reporting window.
+var liveStats = &LiveStats{}
+
+type Result struct {
+    duration            time.Duration
+    completedAt         time.Time
+    promptTokens        int
+    totalTokens         int
+    err                 error
+    streaming           bool
+    ttft                time.Duration
+    interTokenLatencies []time.Duration
+    decodeTokensPerSec  float64
+    queueWait           time.Duration
+    statusCode          int
+}
+
+type Message struct {
+    Role    string `json:"role"`
+    Content string `json:"content"`
+}
+
+type RequestBody struct {
+    Messages  []Message `json:"messages"`
+    Model     string    `json:"model"`
+    MaxTokens int       `json:"max_tokens"`
+    TopP      float64   `json:"top_p"`
+    N         int       `json:"n"`
+    Stream    bool      `json:"stream"`
+}
+
+type RequestConfig struct {
+    Backend     Backend
+    BackendName string
+    Model       string
+    PromptIndex int
+    Prompt      string
+    MaxTokens   int
+    Stream      bool
+}
+
+type ResponseBody struct {
+    ID      string `json:"id"`
+    Object  string `json:"object"`
+    Created int64  `json:"created"`
+    Model   string `json:"model"`
+    Choices []struct {
+        Index   int `json:"index"`
+        Message struct {
+            Role    string `json:"role"`
+            Content string `json:"content"`
+        } `json:"message"`
+    } `json:"choices"`
+    Usage struct {
+        PromptTokens     int `json:"prompt_tokens"`
+        CompletionTokens int `json:"completion_tokens"`
+        TotalTokens      int `json:"total_tokens"`
+    } `json:"usage"`
+}
+
+// StreamChunk models a single `data: {...}` server-sent event emitted by the
+// OpenAI-compatible chat-completions streaming endpoint.
+type StreamChunk struct {
+    Choices []struct {
+        Delta struct {
+            Content string `json:"content"`
+        } `json:"delta"`
+    } `json:"choices"`
+    Usage *struct {
+        PromptTokens     int `json:"prompt_tokens"`
+        CompletionTokens int `json:"completion_tokens"`
+        TotalTokens      int `json:"total_tokens"`
+    } `json:"usage"`
+}
+
+// Backend abstracts the wire protocol of a specific inference server so that
+// request dispatch and response/stream parsing do not need to know whether
+// they are talking to an OpenAI-compatible server, vLLM, TGI or Triton.
+type Backend interface {
+    // BuildRequest returns the non-streaming HTTP request for prompt.
+    BuildRequest(prompt string, maxTokens int) (*http.Request, error)
+    // ParseResponse extracts the prompt and completion token counts from a
+    // non-streaming response body. A backend that can't distinguish the two
+    // (no usage reporting) returns 0 for promptTokens.
+    ParseResponse(body []byte) (promptTokens int, completionTokens int, err error)
+    // BuildStreamingRequest returns the streaming HTTP request for prompt.
+    BuildStreamingRequest(prompt string, maxTokens int) (*http.Request, error)
+    // ParseStreamChunk extracts the incremental content and, once known, the
+    // prompt and completion token counts from a single SSE data payload.
+    // done reports whether the backend's own completion sentinel was seen.
+    ParseStreamChunk(payload []byte) (content string, promptTokens int, completionTokens int, done bool, err error)
+}
+
+// newJSONRequest marshals body as JSON and wraps it in a POST request to url
+// with the headers every backend implementation needs.
+func newJSONRequest(url string, body interface{}, accept string) (*http.Request, error) {
+    jsonData, err := json.Marshal(body)
+    if err != nil {
+        return nil, fmt.Errorf("error marshaling JSON: %v", err)
+    }
+
+    req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+    if err != nil {
+        return nil, fmt.Errorf("error creating request: %v", err)
+    }
+
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Accept", accept)
+    return req, nil
+}
+
+// OpenAIChatBackend talks to an OpenAI-compatible /v1/chat/completions
+// endpoint. It is the backend the benchmark has always used.
+type OpenAIChatBackend struct {
+    url   string
+    model string
+}
+
+func (b OpenAIChatBackend) BuildRequest(prompt string, maxTokens int) (*http.Request, error) {
+    reqBody := RequestBody{
+        Messages:  []Message{{Role: "user", Content: prompt}},
+        Model:     b.model,
+        MaxTokens: maxTokens,
+        TopP:      1,
+        N:         1,
+        Stream:    false,
+    }
+    return newJSONRequest(b.url, reqBody, "application/json")
+}
+
+func (b OpenAIChatBackend) ParseResponse(body []byte) (int, int, error) {
+    var respBody ResponseBody
+    if err := json.Unmarshal(body, &respBody); err != nil {
+        return 0, 0, fmt.Errorf("error parsing response JSON: %v", err)
+    }
+    return respBody.Usage.PromptTokens, respBody.Usage.CompletionTokens, nil
+}
+
+func (b OpenAIChatBackend) BuildStreamingRequest(prompt string, maxTokens int) (*http.Request, error) {
+    reqBody := RequestBody{
+        Messages:  []Message{{Role: "user", Content: prompt}},
+        Model:     b.model,
+        MaxTokens: maxTokens,
+        TopP:      1,
+        N:         1,
+        Stream:    true,
+    }
+    return newJSONRequest(b.url, reqBody, "text/event-stream")
+}
+
+func (b OpenAIChatBackend) ParseStreamChunk(payload []byte) (string, int, int, bool, error) {
+    if string(payload) == "[DONE]" {
+        return "", 0, 0, true, nil
+    }
+
+    var chunk StreamChunk
+    if err := json.Unmarshal(payload, &chunk); err != nil {
+        return "", 0, 0, false, err
+    }
+
+    var promptTokens, completionTokens int
+    if chunk.Usage != nil {
+        promptTokens = chunk.Usage.PromptTokens
+        completionTokens = chunk.Usage.CompletionTokens
+    }
+
+    var content string
+    for _, choice := range chunk.Choices {
+        content += choice.Delta.Content
+    }
+
+    return content, promptTokens, completionTokens, false, nil
+}
+
+type openAICompletionsRequestBody struct {
+    Model     string  `json:"model"`
+    Prompt    string  `json:"prompt"`
+    MaxTokens int     `json:"max_tokens"`
+    TopP      float64 `json:"top_p"`
+    N         int     `json:"n"`
+    Stream    bool    `json:"stream"`
+}
+
+type openAICompletionsResponseBody struct {
+    Choices []struct {
+        Text string `json:"text"`
+    } `json:"choices"`
+    Usage struct {
+        PromptTokens     int `json:"prompt_tokens"`
+        CompletionTokens int `json:"completion_tokens"`
+        TotalTokens      int `json:"total_tokens"`
+    } `json:"usage"`
+}
+
+type openAICompletionsStreamChunk struct {
+    Choices []struct {
+        Text string `json:"text"`
+    } `json:"choices"`
+    Usage *struct {
+        PromptTokens     int `json:"prompt_tokens"`
+        CompletionTokens int `json:"completion_tokens"`
+        TotalTokens      int `json:"total_tokens"`
+    } `json:"usage"`
+}
+
+// OpenAICompletionsBackend talks to an OpenAI-compatible /v1/completions
+// endpoint, as served by vLLM's native API.
+type OpenAICompletionsBackend struct {
+    url   string
+    model string
+}
+
+func (b OpenAICompletionsBackend) BuildRequest(prompt string, maxTokens int) (*http.Request, error) {
+    reqBody := openAICompletionsRequestBody{
+        Model:     b.model,
+        Prompt:    prompt,
+        MaxTokens: maxTokens,
+        TopP:      1,
+        N:         1,
+        Stream:    false,
+    }
+    return newJSONRequest(b.url, reqBody, "application/json")
+}
+
+func (b OpenAICompletionsBackend) ParseResponse(body []byte) (int, int, error) {
+    var respBody openAICompletionsResponseBody
+    if err := json.Unmarshal(body, &respBody); err != nil {
+        return 0, 0, fmt.Errorf("error parsing response JSON: %v", err)
+    }
+    return respBody.Usage.PromptTokens, respBody.Usage.CompletionTokens, nil
+}
+
+func (b OpenAICompletionsBackend) BuildStreamingRequest(prompt string, maxTokens int) (*http.Request, error) {
+    reqBody := openAICompletionsRequestBody{
+        Model:     b.model,
+        Prompt:    prompt,
+        MaxTokens: maxTokens,
+        TopP:      1,
+        N:         1,
+        Stream:    true,
+    }
+    return newJSONRequest(b.url, reqBody, "text/event-stream")
+}
+
+func (b OpenAICompletionsBackend) ParseStreamChunk(payload []byte) (string, int, int, bool, error) {
+    if string(payload) == "[DONE]" {
+        return "", 0, 0, true, nil
+    }
+
+    var chunk openAICompletionsStreamChunk
+    if err := json.Unmarshal(payload, &chunk); err != nil {
+        return "", 0, 0, false, err
+    }
+
+    var promptTokens, completionTokens int
+    if chunk.Usage != nil {
+        promptTokens = chunk.Usage.PromptTokens
+        completionTokens = chunk.Usage.CompletionTokens
+    }
+
+    var content string
+    for _, choice := range chunk.Choices {
+        content += choice.Text
+    }
+
+    return content, promptTokens, completionTokens, false, nil
+}
+
+// VLLMBackend is an alias for OpenAICompletionsBackend: vLLM's native
+// /v1/completions API is wire-compatible with OpenAI's, but BACKEND=vllm is
+// kept as its own selectable value since operators think of it as a
+// distinct deployment target.
+type VLLMBackend = OpenAICompletionsBackend
+
+type tgiRequestBody struct {
+    Inputs     string `json:"inputs"`
+    Parameters struct {
+        MaxNewTokens int `json:"max_new_tokens"`
+    } `json:"parameters"`
+}
+
+type tgiResponseBody struct {
+    GeneratedText string `json:"generated_text"`
+}
+
+type tgiStreamChunk struct {
+    Token struct {
+        Text string `json:"text"`
+    } `json:"token"`
+    GeneratedText *string `json:"generated_text"`
+}
+
+// TGIBackend talks to a Hugging Face Text Generation Inference server's
+// /generate and /generate_stream endpoints.
+type TGIBackend struct {
+    url   string
+    model string // unused: TGI serves a single model per deployment
+}
+
+func (b TGIBackend) buildBody(prompt string, maxTokens int) tgiRequestBody {
+    reqBody := tgiRequestBody{Inputs: prompt}
+    reqBody.Parameters.MaxNewTokens = maxTokens
+    return reqBody
+}
+
+func (b TGIBackend) BuildRequest(prompt string, maxTokens int) (*http.Request, error) {
+    return newJSONRequest(b.url+"/generate", b.buildBody(prompt, maxTokens), "application/json")
+}
+
+func (b TGIBackend) ParseResponse(body []byte) (int, int, error) {
+    var respBody tgiResponseBody
+    if err := json.Unmarshal(body, &respBody); err != nil {
+        return 0, 0, fmt.Errorf("error parsing response JSON: %v", err)
+    }
+    // TGI's /generate does not report prompt/completion token usage, so
+    // approximate completion tokens by counting whitespace-separated words
+    // in the generated text; prompt tokens are left at 0 since TGI gives us
+    // no way to estimate them from the response alone.
+    return 0, len(strings.Fields(respBody.GeneratedText)), nil
+}
+
+func (b TGIBackend) BuildStreamingRequest(prompt string, maxTokens int) (*http.Request, error) {
+    return newJSONRequest(b.url+"/generate_stream", b.buildBody(prompt, maxTokens), "text/event-stream")
+}
+
+func (b TGIBackend) ParseStreamChunk(payload []byte) (string, int, int, bool, error) {
+    var chunk tgiStreamChunk
+    if err := json.Unmarshal(payload, &chunk); err != nil {
+        return "", 0, 0, false, err
+    }
+
+    if chunk.GeneratedText != nil {
+        return chunk.Token.Text, 0, len(strings.Fields(*chunk.GeneratedText)), true, nil
+    }
+
+    return chunk.Token.Text, 0, 0, false, nil
+}
+
+type tritonRequestBody struct {
+    TextInput  string `json:"text_input"`
+    Parameters struct {
+        MaxTokens int  `json:"max_tokens"`
+        Stream    bool `json:"stream"`
+    } `json:"parameters"`
+}
+
+type tritonResponseBody struct {
+    TextOutput string `json:"text_output"`
+}
+
+// TritonBackend talks to an NVIDIA Triton Inference Server model exposing
+// the generate / generate_stream HTTP endpoints served by the vLLM and
+// TensorRT-LLM backends.
+type TritonBackend struct {
+    url   string
+    model string
+}
+
+func (b TritonBackend) endpoint(suffix string) string {
+    return fmt.Sprintf("%s/v2/models/%s/%s", b.url, b.model, suffix)
+}
+
+func (b TritonBackend) buildBody(prompt string, maxTokens int, stream bool) tritonRequestBody {
+    reqBody := tritonRequestBody{TextInput: prompt}
+    reqBody.Parameters.MaxTokens = maxTokens
+    reqBody.Parameters.Stream = stream
+    return reqBody
+}
+
+func (b TritonBackend) BuildRequest(prompt string, maxTokens int) (*http.Request, error) {
+    return newJSONRequest(b.endpoint("generate"), b.buildBody(prompt, maxTokens, false), "application/json")
+}
+
+func (b TritonBackend) ParseResponse(body []byte) (int, int, error) {
+    var respBody tritonResponseBody
+    if err := json.Unmarshal(body, &respBody); err != nil {
+        return 0, 0, fmt.Errorf("error parsing response JSON: %v", err)
+    }
+    // Triton's generate endpoint does not report prompt/completion token
+    // usage, so approximate completion tokens by counting
+    // whitespace-separated words in the output; prompt tokens are left at 0
+    // since Triton gives us no way to estimate them from the response alone.
+    return 0, len(strings.Fields(respBody.TextOutput)), nil
+}
+
+func (b TritonBackend) BuildStreamingRequest(prompt string, maxTokens int) (*http.Request, error) {
+    return newJSONRequest(b.endpoint("generate_stream"), b.buildBody(prompt, maxTokens, true), "text/event-stream")
+}
+
+func (b TritonBackend) ParseStreamChunk(payload []byte) (string, int, int, bool, error) {
+    var chunk tritonResponseBody
+    if err := json.Unmarshal(payload, &chunk); err != nil {
+        return "", 0, 0, false, err
+    }
+
+    // Some Triton servers report text_output cumulatively rather than as an
+    // incremental delta. Treating it as the delta directly here is a
+    // pragmatic simplification for a benchmarking tool: diffing against the
+    // previous chunk would require mutable per-request state on a Backend
+    // value that is shared across concurrently-dispatched goroutines.
+    return chunk.TextOutput, 0, len(strings.Fields(chunk.TextOutput)), false, nil
+}
+
+// defaultURLForBackend returns the endpoint a fresh deployment of the given
+// backend is typically reachable at on localhost, so switching BACKEND
+// without also overriding URL doesn't point it at another backend's path
+// and wire format.
+func defaultURLForBackend(name string) string {
+    switch name {
+    case "openai-completions", "vllm":
+        return "http://localhost:8000/v1/completions"
+    case "tgi":
+        return "http://localhost:8080"
+    case "triton":
+        return "http://localhost:8000"
+    default:
+        return "http://localhost:8000/v1/chat/completions"
+    }
+}
+
+// newBackend constructs the Backend implementation selected by name,
+// defaulting to the OpenAI chat-completions wire format the benchmark has
+// always used.
+func newBackend(name, url, model string) (Backend, error) {
+    switch name {
+    case "", "openai-chat":
+        return OpenAIChatBackend{url: url, model: model}, nil
+    case "openai-completions":
+        return OpenAICompletionsBackend{url: url, model: model}, nil
+    case "vllm":
+        return VLLMBackend{url: url, model: model}, nil
+    case "tgi":
+        return TGIBackend{url: url, model: model}, nil
+    case "triton":
+        return TritonBackend{url: url, model: model}, nil
+    default:
+        return nil, fmt.Errorf("unknown backend %q", name)
+    }
+}
+
+// StreamStats holds the averaged streaming-specific metrics for a batch of
+// streaming requests: time-to-first-token, inter-token latency and decode
+// throughput.
+type StreamStats struct {
+    avgTTFT               time.Duration
+    avgInterTokenLatency  time.Duration
+    avgDecodeTokensPerSec float64
+}
+
+// LatencyStats holds percentile and min/max latency summaries computed from
+// a slice of raw per-request durations.
+type LatencyStats struct {
+    p50 time.Duration
+    p90 time.Duration
+    p95 time.Duration
+    p99 time.Duration
+    min time.Duration
+    max time.Duration
+}
+
+// computeLatencyStats sorts the given durations and derives percentile and
+// min/max summaries. Each percentile p is the sorted sample at index
+// floor(p*(n-1)), so it reflects an actually observed latency rather than an
+// interpolation.
+func computeLatencyStats(durations []time.Duration) LatencyStats {
+    if len(durations) == 0 {
+        return LatencyStats{}
+    }
+
+    sorted := make([]time.Duration, len(durations))
+    copy(sorted, durations)
+    sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+    percentile := func(p float64) time.Duration {
+        idx := int(p * float64(len(sorted)-1))
+        return sorted[idx]
+    }
+
+    return LatencyStats{
+        p50: percentile(0.50),
+        p90: percentile(0.90),
+        p95: percentile(0.95),
+        p99: percentile(0.99),
+        min: sorted[0],
+        max: sorted[len(sorted)-1],
+    }
+}
+
+// PromptStats is the raw result of running a batch of requests for a single
+// prompt: every per-request duration (for percentile computation), the
+// actual total tokens observed, and the streaming aggregates if applicable.
+type PromptStats struct {
+    durations    []time.Duration
+    totalTokens  int
+    successful   int
+    streamStats  StreamStats
+    avgQueueWait time.Duration
+    targetQPS    float64
+    achievedQPS  float64
+    // openLoopTime is the actual open-loop arrival duration (zero for
+    // closed-loop prompts), kept alongside achievedQPS so callers can
+    // accumulate it across prompts for an overall open-loop QPS figure.
+    openLoopTime time.Duration
+}
+
+// statSummary holds a min/avg/max/p95 summary computed from a slice of
+// float64 samples, with p95 picked the same way LatencyStats picks it for
+// durations.
+type statSummary struct {
+    min float64
+    avg float64
+    max float64
+    p95 float64
+}
+
+func summarizeFloats(values []float64) statSummary {
+    if len(values) == 0 {
+        return statSummary{}
+    }
+
+    sorted := make([]float64, len(values))
+    copy(sorted, values)
+    sort.Float64s(sorted)
+
+    var sum float64
+    for _, v := range sorted {
+        sum += v
+    }
+    p95Idx := int(0.95 * float64(len(sorted)-1))
+
+    return statSummary{
+        min: sorted[0],
+        avg: sum / float64(len(sorted)),
+        max: sorted[len(sorted)-1],
+        p95: sorted[p95Idx],
+    }
+}
+
+// RequestRecord is one row of the OUT_JSON / OUT_CSV per-request export: a
+// self-contained record of a single request's outcome, meant for comparing
+// runs (e.g. across Karpenter node types) in CI or feeding a dashboard.
+type RequestRecord struct {
+    Timestamp        time.Time `json:"timestamp"`
+    PromptIndex      int       `json:"prompt_index"`
+    PromptHash       string    `json:"prompt_hash"`
+    Backend          string    `json:"backend"`
+    Model            string    `json:"model"`
+    StatusCode       int       `json:"status_code"`
+    DurationMs       float64   `json:"duration_ms"`
+    TTFTMs           float64   `json:"ttft_ms"`
+    DecodeMs         float64   `json:"decode_ms"`
+    PromptTokens     int       `json:"prompt_tokens"`
+    CompletionTokens int       `json:"completion_tokens"`
+    Load1            float64   `json:"load1"`
+    CPUPercent       float64   `json:"cpu_percent"`
+    MemUsedPercent   float64   `json:"mem_used_percent"`
+    Error            string    `json:"error"`
+}
+
+// hashPrompt returns a short, stable identifier for a prompt so records for
+// the same prompt can be correlated across runs without embedding the full
+// prompt text in every row.
+func hashPrompt(prompt string) string {
+    sum := sha256.Sum256([]byte(prompt))
+    return fmt.Sprintf("%x", sum)[:12]
+}
+
+// statSummaryJSON is the JSON-marshalable shape of a statSummary.
+type statSummaryJSON struct {
+    Min float64 `json:"min"`
+    Avg float64 `json:"avg"`
+    Max float64 `json:"max"`
+    P95 float64 `json:"p95"`
+}
+
+func toJSONSummary(s statSummary) statSummaryJSON {
+    return statSummaryJSON{Min: s.min, Avg: s.avg, Max: s.max, P95: s.p95}
+}
+
+// SystemMetricsSummary is the system-metric aggregate written into
+// summary.json, covering the same host/GPU/target samples printSystemMetrics
+// reports on stdout.
+type SystemMetricsSummary struct {
+    SamplesCollected int                        `json:"samples_collected"`
+    Load1            statSummaryJSON            `json:"load1"`
+    CPUTotalPercent  statSummaryJSON            `json:"cpu_total_percent"`
+    MemUsedPercent   statSummaryJSON            `json:"mem_used_percent"`
+    GPUUtilPercent   *statSummaryJSON           `json:"gpu_util_percent,omitempty"`
+    GPUMemUsedMB     *statSummaryJSON           `json:"gpu_mem_used_mb,omitempty"`
+    TargetMetrics    map[string]statSummaryJSON `json:"target_metrics,omitempty"`
+}
+
+// RunSummary is the top-level aggregate written to summary.json: overall
+// latency percentiles, success rate, achieved QPS and system-metric
+// aggregates for the whole benchmark run.
+type RunSummary struct {
+    TotalRequests      int                   `json:"total_requests"`
+    SuccessfulRequests int                   `json:"successful_requests"`
+    SuccessRatePct     float64               `json:"success_rate_pct"`
+    LatencyP50Ms       float64               `json:"latency_p50_ms"`
+    LatencyP90Ms       float64               `json:"latency_p90_ms"`
+    LatencyP95Ms       float64               `json:"latency_p95_ms"`
+    LatencyP99Ms       float64               `json:"latency_p99_ms"`
+    LatencyMinMs       float64               `json:"latency_min_ms"`
+    LatencyMaxMs       float64               `json:"latency_max_ms"`
+    TokensPerSecond    float64               `json:"tokens_per_second"`
+    TargetQPS          float64               `json:"target_qps,omitempty"`
+    AchievedQPS        float64               `json:"achieved_qps,omitempty"`
+    SystemMetrics      *SystemMetricsSummary `json:"system_metrics,omitempty"`
+}
+
+// writeJSONRecords writes records as an indented JSON array to path.
+func writeJSONRecords(path string, records []RequestRecord) error {
+    data, err := json.MarshalIndent(records, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling records: %v", err)
+    }
+    return ioutil.WriteFile(path, data, 0644)
+}
+
+// writeCSVRecords writes records as CSV to path, one row per request plus a
+// header row.
+func writeCSVRecords(path string, records []RequestRecord) error {
+    f, err := os.Create(path)
+    if err != nil {
+        return fmt.Errorf("error creating %s: %v", path, err)
+    }
+    defer f.Close()
+
+    w := csv.NewWriter(f)
+    defer w.Flush()
+
+    header := []string{
+        "timestamp", "prompt_index", "prompt_hash", "backend", "model",
+        "status_code", "duration_ms", "ttft_ms", "decode_ms",
+        "prompt_tokens", "completion_tokens",
+        "load1", "cpu_percent", "mem_used_percent", "error",
+    }
+    if err := w.Write(header); err != nil {
+        return fmt.Errorf("error writing CSV header: %v", err)
+    }
+
+    for _, r := range records {
+        row := []string{
+            r.Timestamp.Format(time.RFC3339),
+            strconv.Itoa(r.PromptIndex),
+            r.PromptHash,
+            r.Backend,
+            r.Model,
+            strconv.Itoa(r.StatusCode),
+            strconv.FormatFloat(r.DurationMs, 'f', 2, 64),
+            strconv.FormatFloat(r.TTFTMs, 'f', 2, 64),
+            strconv.FormatFloat(r.DecodeMs, 'f', 2, 64),
+            strconv.Itoa(r.PromptTokens),
+            strconv.Itoa(r.CompletionTokens),
+            strconv.FormatFloat(r.Load1, 'f', 2, 64),
+            strconv.FormatFloat(r.CPUPercent, 'f', 2, 64),
+            strconv.FormatFloat(r.MemUsedPercent, 'f', 2, 64),
+            r.Error,
+        }
+        if err := w.Write(row); err != nil {
+            return fmt.Errorf("error writing CSV row: %v", err)
+        }
+    }
+
+    return w.Error()
+}
+
+// writeSummaryJSON writes the aggregated run summary to path.
+func writeSummaryJSON(path string, summary RunSummary) error {
+    data, err := json.MarshalIndent(summary, "", "  ")
+    if err != nil {
+        return fmt.Errorf("error marshaling summary: %v", err)
+    }
+    return ioutil.WriteFile(path, data, 0644)
+}
+
+// buildSystemMetricsSummary aggregates the sampler's raw samples into the
+// same JSON shape used for export, mirroring the fields printSystemMetrics
+// reports on stdout.
+func buildSystemMetricsSummary(sampler *SystemSampler) *SystemMetricsSummary {
+    if len(sampler.samples) == 0 {
+        return nil
+    }
+
+    var load1s, cpuPercents, memPercents, gpuUtils, gpuMems []float64
+    for _, s := range sampler.samples {
+        load1s = append(load1s, s.load1)
+        cpuPercents = append(cpuPercents, s.cpuPercent)
+        memPercents = append(memPercents, s.memUsedPercent)
+        if sampler.gpuReady {
+            gpuUtils = append(gpuUtils, s.gpuUtilPercent)
+            gpuMems = append(gpuMems, s.gpuMemUsedMB)
+        }
+    }
+
+    summary := &SystemMetricsSummary{
+        SamplesCollected: len(sampler.samples),
+        Load1:            toJSONSummary(summarizeFloats(load1s)),
+        CPUTotalPercent:  toJSONSummary(summarizeFloats(cpuPercents)),
+        MemUsedPercent:   toJSONSummary(summarizeFloats(memPercents)),
+    }
+
+    if sampler.gpuReady {
+        gpuUtil := toJSONSummary(summarizeFloats(gpuUtils))
+        gpuMem := toJSONSummary(summarizeFloats(gpuMems))
+        summary.GPUUtilPercent = &gpuUtil
+        summary.GPUMemUsedMB = &gpuMem
+    }
+
+    if len(sampler.targetSamples) > 0 {
+        merged := make(map[string][]float64)
+        for _, sample := range sampler.targetSamples {
+            for name, value := range sample.values {
+                merged[name] = append(merged[name], value)
+            }
+        }
+
+        summary.TargetMetrics = make(map[string]statSummaryJSON, len(merged))
+        for name, values := range merged {
+            summary.TargetMetrics[name] = toJSONSummary(summarizeFloats(values))
+        }
+    }
+
+    return summary
+}
+
+// SystemSample is one second of host pressure readings taken alongside the
+// benchmark's request traffic.
+type SystemSample struct {
+    timestamp      time.Time
+    load1          float64
+    cpuPercent     float64
+    perCPUPercent  []float64
+    memUsedPercent float64
+    gpuUtilPercent float64
+    gpuMemUsedMB   float64
+}
+
+// TargetMetricSample is one scrape of TARGET_METRICS_URL, keyed by bare
+// metric name (Prometheus label sets are stripped).
+type TargetMetricSample struct {
+    timestamp time.Time
+    values    map[string]float64
+}
+
+// SystemSampler samples host (and optionally GPU and remote Prometheus)
+// metrics on a fixed cadence from a background goroutine so they can be
+// correlated against the request latencies collected during the same run.
+type SystemSampler struct {
+    mu            sync.Mutex
+    samples       []SystemSample
+    targetSamples []TargetMetricSample
+    targetURL     string
+    gpuReady      bool
+    gpuDevice     nvml.Device
+    stop          chan struct{}
+    done          chan struct{}
+}
+
+func newSystemSampler(gpuEnabled bool, targetURL string) *SystemSampler {
+    s := &SystemSampler{
+        targetURL: targetURL,
+        stop:      make(chan struct{}),
+        done:      make(chan struct{}),
+    }
+
+    if gpuEnabled {
+        if ret := nvml.Init(); ret != nvml.SUCCESS {
+            fmt.Printf("GPU metrics disabled: nvml init failed: %v\n", nvml.ErrorString(ret))
+        } else if device, ret := nvml.DeviceGetHandleByIndex(0); ret != nvml.SUCCESS {
+            fmt.Printf("GPU metrics disabled: nvml device lookup failed: %v\n", nvml.ErrorString(ret))
+            nvml.Shutdown()
+        } else {
+            s.gpuDevice = device
+            s.gpuReady = true
+        }
+    }
+
+    return s
+}
+
+func (s *SystemSampler) start(interval time.Duration) {
+    go func() {
+        defer close(s.done)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-s.stop:
+                return
+            case <-ticker.C:
+                s.sampleOnce()
+            }
+        }
+    }()
+}
+
+func (s *SystemSampler) sampleOnce() {
+    sample := SystemSample{timestamp: time.Now()}
+
+    if avg, err := load.Avg(); err == nil {
+        sample.load1 = avg.Load1
+    }
+    if total, err := cpu.Percent(0, false); err == nil && len(total) > 0 {
+        sample.cpuPercent = total[0]
+    }
+    if perCPU, err := cpu.Percent(0, true); err == nil {
+        sample.perCPUPercent = perCPU
+    }
+    if vm, err := mem.VirtualMemory(); err == nil {
+        sample.memUsedPercent = vm.UsedPercent
+    }
+
+    if s.gpuReady {
+        if util, ret := s.gpuDevice.GetUtilizationRates(); ret == nvml.SUCCESS {
+            sample.gpuUtilPercent = float64(util.Gpu)
+        }
+        if meminfo, ret := s.gpuDevice.GetMemoryInfo(); ret == nvml.SUCCESS {
+            sample.gpuMemUsedMB = float64(meminfo.Used) / (1024 * 1024)
+        }
+    }
+
+    s.mu.Lock()
+    s.samples = append(s.samples, sample)
+    s.mu.Unlock()
+
+    if s.targetURL != "" {
+        if values, err := scrapeTargetMetrics(s.targetURL); err == nil {
+            s.mu.Lock()
+            s.targetSamples = append(s.targetSamples, TargetMetricSample{timestamp: time.Now(), values: values})
+            s.mu.Unlock()
+        } else {
+            fmt.Printf("Target metrics scrape error: %v\n", err)
+        }
+    }
+}
+
+func (s *SystemSampler) stopAndWait() {
+    close(s.stop)
+    <-s.done
+    if s.gpuReady {
+        nvml.Shutdown()
+    }
+}
+
+// nearestSample returns the collected SystemSample whose timestamp is
+// closest to t, so a request's host pressure at completion time can be
+// attached to its RequestRecord. Returns false if no samples have been
+// collected yet (e.g. the request completed before the first tick).
+func (s *SystemSampler) nearestSample(t time.Time) (SystemSample, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if len(s.samples) == 0 {
+        return SystemSample{}, false
+    }
+
+    best := s.samples[0]
+    bestDiff := t.Sub(best.timestamp).Abs()
+    for _, sample := range s.samples[1:] {
+        if diff := t.Sub(sample.timestamp).Abs(); diff < bestDiff {
+            best, bestDiff = sample, diff
+        }
+    }
+    return best, true
+}
+
+// targetMetricsClient bounds each scrape well under the sampler's 1-second
+// cadence so a slow or unresponsive TARGET_METRICS_URL can't stall the
+// sampling goroutine (and with it every other metric it collects).
+var targetMetricsClient = &http.Client{
+    Timeout: 500 * time.Millisecond,
+}
+
+// scrapeTargetMetrics does a best-effort parse of a Prometheus text-format
+// /metrics response: each non-comment "name{labels} value" line is kept
+// under its bare metric name, with labels stripped.
+func scrapeTargetMetrics(url string) (map[string]float64, error) {
+    resp, err := targetMetricsClient.Get(url)
+    if err != nil {
+        return nil, fmt.Errorf("error scraping %s: %v", url, err)
+    }
+    defer resp.Body.Close()
+
+    values := make(map[string]float64)
+    scanner := bufio.NewScanner(resp.Body)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+
+        fields := strings.Fields(line)
+        if len(fields) != 2 {
+            continue
+        }
+
+        name := fields[0]
+        if idx := strings.Index(name, "{"); idx != -1 {
+            name = name[:idx]
+        }
+
+        value, err := strconv.ParseFloat(fields[1], 64)
+        if err != nil {
+            continue
+        }
+        values[name] = value
+    }
+
+    return values, scanner.Err()
+}
+
+// perCoreAverages averages each CPU core's percentage across every sample,
+// assuming a stable core count for the duration of the run.
+func perCoreAverages(samples []SystemSample) []float64 {
+    if len(samples) == 0 || len(samples[0].perCPUPercent) == 0 {
+        return nil
+    }
+
+    numCores := len(samples[0].perCPUPercent)
+    sums := make([]float64, numCores)
+    counts := make([]int, numCores)
+    for _, s := range samples {
+        for i, v := range s.perCPUPercent {
+            if i < numCores {
+                sums[i] += v
+                counts[i]++
+            }
+        }
+    }
+
+    averages := make([]float64, numCores)
+    for i := range averages {
+        if counts[i] > 0 {
+            averages[i] = sums[i] / float64(counts[i])
+        }
+    }
+    return averages
 }
 
-type Message struct {
-    Role    string `json:"role"`
-    Content string `json:"content"`
+func printStatLine(label string, s statSummary) {
+    fmt.Printf("%s - min/avg/max/p95: %.2f / %.2f / %.2f / %.2f\n", label, s.min, s.avg, s.max, s.p95)
 }
 
-type RequestBody struct {
-    Messages  []Message `json:"messages"`
-    Model     string    `json:"model"`
-    MaxTokens int       `json:"max_tokens"`
-    TopP      float64   `json:"top_p"`
-    N         int       `json:"n"`
-    Stream    bool      `json:"stream"`
+// printSystemMetrics reports the host (and optional GPU / remote target)
+// pressure observed over the run alongside the request latencies.
+func printSystemMetrics(sampler *SystemSampler) {
+    if len(sampler.samples) == 0 {
+        return
+    }
+
+    var load1s, cpuPercents, memPercents, gpuUtils, gpuMems []float64
+    for _, s := range sampler.samples {
+        load1s = append(load1s, s.load1)
+        cpuPercents = append(cpuPercents, s.cpuPercent)
+        memPercents = append(memPercents, s.memUsedPercent)
+        if sampler.gpuReady {
+            gpuUtils = append(gpuUtils, s.gpuUtilPercent)
+            gpuMems = append(gpuMems, s.gpuMemUsedMB)
+        }
+    }
+
+    fmt.Printf("\n=== System Metrics ===\n")
+    fmt.Printf("Samples collected: %d\n", len(sampler.samples))
+    printStatLine("Load Avg (1m)", summarizeFloats(load1s))
+    printStatLine("CPU Total %", summarizeFloats(cpuPercents))
+    if cores := perCoreAverages(sampler.samples); len(cores) > 0 {
+        parts := make([]string, len(cores))
+        for i, v := range cores {
+            parts[i] = fmt.Sprintf("core%d=%.1f%%", i, v)
+        }
+        fmt.Printf("CPU Per-Core Avg: %s\n", strings.Join(parts, ", "))
+    }
+    printStatLine("Memory Used %", summarizeFloats(memPercents))
+
+    if sampler.gpuReady {
+        printStatLine("GPU Utilization %", summarizeFloats(gpuUtils))
+        printStatLine("GPU Memory Used (MB)", summarizeFloats(gpuMems))
+    }
+
+    if len(sampler.targetSamples) > 0 {
+        fmt.Printf("\n--- Target Metrics (%s) ---\n", sampler.targetURL)
+
+        merged := make(map[string][]float64)
+        for _, sample := range sampler.targetSamples {
+            for name, value := range sample.values {
+                merged[name] = append(merged[name], value)
+            }
+        }
+
+        names := make([]string, 0, len(merged))
+        for name := range merged {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+
+        for _, name := range names {
+            printStatLine(name, summarizeFloats(merged[name]))
+        }
+    }
 }
 
-type RequestConfig struct {
-    URL       string
-    Prompt    string
-    MaxTokens int
+// LoadGenConfig selects between the two load generation modes: a
+// fixed-concurrency closed loop (workers pull from a queue until the target
+// count is reached) or a fixed-QPS open loop (Poisson arrivals). Exactly one
+// of concurrency or qps is set.
+type LoadGenConfig struct {
+    concurrency int
+    qps         float64
 }
 
-type ResponseBody struct {
-    ID      string `json:"id"`
-    Object  string `json:"object"`
-    Created int64  `json:"created"`
-    Model   string `json:"model"`
-    Choices []struct {
-        Index   int `json:"index"`
-        Message struct {
-            Role    string `json:"role"`
-            Content string `json:"content"`
-        } `json:"message"`
-    } `json:"choices"`
-    Usage struct {
-        TotalTokens int `json:"total_tokens"`
-    } `json:"usage"`
+// resolveLoadGenConfig reads QPS/CONCURRENCY from the environment. QPS takes
+// priority when both are set. With neither set it defaults to a
+// fixed-concurrency closed loop sized to the batch, which keeps every
+// request in flight at once the way earlier ad-hoc behavior effectively did.
+func resolveLoadGenConfig(numRequests int) LoadGenConfig {
+    if envVal := os.Getenv("QPS"); envVal != "" {
+        if val, err := strconv.ParseFloat(envVal, 64); err == nil && val > 0 {
+            return LoadGenConfig{qps: val}
+        }
+    }
+
+    concurrency := numRequests
+    if envVal := os.Getenv("CONCURRENCY"); envVal != "" {
+        if val, err := strconv.Atoi(envVal); err == nil && val > 0 {
+            concurrency = val
+        }
+    }
+    return LoadGenConfig{concurrency: concurrency}
+}
+
+// runClosedLoop keeps exactly `concurrency` workers in flight, pulling jobs
+// from a pre-filled queue until `numRequests` have been dispatched. The
+// queue wait for a job is the time between the batch starting and a worker
+// actually becoming free to run it, which is 0 unless concurrency < numRequests.
+func runClosedLoop(config RequestConfig, numRequests int, concurrency int, results chan<- Result) {
+    batchStart := time.Now()
+    jobs := make(chan struct{}, numRequests)
+    for i := 0; i < numRequests; i++ {
+        jobs <- struct{}{}
+    }
+    close(jobs)
+
+    var wg sync.WaitGroup
+    for w := 0; w < concurrency; w++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for range jobs {
+                dispatch(config, time.Since(batchStart), results)
+            }
+        }()
+    }
+    wg.Wait()
+}
+
+// runOpenLoop fires requests at Poisson-distributed arrival times with the
+// given target rate, without waiting for earlier requests to finish, so
+// queueing delay (actual dispatch vs. scheduled arrival) is observable
+// instead of hidden behind client-side backpressure. Returns the arrival
+// duration — the span from start to the last scheduled arrival, not how
+// long those requests took to complete — for computing the achieved QPS;
+// completion is reported independently through results, which dispatch's
+// goroutines keep writing to after this function returns.
+func runOpenLoop(config RequestConfig, numRequests int, targetQPS float64, results chan<- Result) time.Duration {
+    start := time.Now()
+    scheduledAt := start
+    lastScheduledAt := start
+
+    for i := 0; i < numRequests; i++ {
+        lastScheduledAt = scheduledAt
+        go func(scheduledAt time.Time) {
+            if wait := time.Until(scheduledAt); wait > 0 {
+                time.Sleep(wait)
+            }
+            queueWait := time.Since(scheduledAt)
+            if queueWait < 0 {
+                queueWait = 0
+            }
+            dispatch(config, queueWait, results)
+        }(scheduledAt)
+
+        interArrival := time.Duration(rand.ExpFloat64() / targetQPS * float64(time.Second))
+        scheduledAt = scheduledAt.Add(interArrival)
+    }
+
+    return lastScheduledAt.Sub(start)
+}
+
+// dispatch runs a single request and stamps the resulting Result with the
+// queue wait observed by the caller before the request was sent.
+func dispatch(config RequestConfig, queueWait time.Duration, results chan<- Result) {
+    raw := make(chan Result, 1)
+    makeRequest(config, raw)
+    result := <-raw
+    result.queueWait = queueWait
+    result.completedAt = time.Now()
+    results <- result
+}
+
+// LiveStats holds cumulative, monotonically increasing counters updated from
+// makeRequest as each request completes. A mutex is enough here since
+// updates happen once per request rather than per token.
+type LiveStats struct {
+    mu          sync.Mutex
+    completed   int64
+    errors      int64
+    totalTokens int64
+    totalBytes  int64
+    latencies   []time.Duration
+}
+
+func (s *LiveStats) recordSuccess(duration time.Duration, tokens int, bytes int) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.completed++
+    s.totalTokens += int64(tokens)
+    s.totalBytes += int64(bytes)
+    s.latencies = append(s.latencies, duration)
+}
+
+func (s *LiveStats) recordError() {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.errors++
+}
+
+// liveStatsSnapshot is a point-in-time read of the cumulative counters, plus
+// the latencies observed since the previous snapshot (that window is drained
+// on read so it only ever reflects the most recent reporting interval).
+type liveStatsSnapshot struct {
+    completed   int64
+    errors      int64
+    totalTokens int64
+    totalBytes  int64
+    latencies   []time.Duration
+}
+
+func (s *LiveStats) snapshot() liveStatsSnapshot {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    latencies := s.latencies
+    s.latencies = nil
+    return liveStatsSnapshot{
+        completed:   s.completed,
+        errors:      s.errors,
+        totalTokens: s.totalTokens,
+        totalBytes:  s.totalBytes,
+        latencies:   latencies,
+    }
+}
+
+// startLiveReporter prints a rolling summary of stats every interval: requests
+// and errors completed since the last tick, tokens/sec and bytes/sec
+// (humanized), and the latency p95 over that same window. baseline is a
+// snapshot taken just before the reporter starts (e.g. right after warmup),
+// so the first window's deltas don't include whatever already accumulated
+// in stats. This mirrors the cumulative-counter-plus-delta pattern of a
+// stats loop sampling a running total and printing deltas over an elapsed
+// window. Returns a stop function that blocks until the reporter goroutine
+// has exited.
+func startLiveReporter(stats *LiveStats, interval time.Duration, baseline liveStatsSnapshot) func() {
+    stopCh := make(chan struct{})
+    done := make(chan struct{})
+
+    go func() {
+        defer close(done)
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        lastCompleted, lastErrors, lastTokens, lastBytes := baseline.completed, baseline.errors, baseline.totalTokens, baseline.totalBytes
+        lastTick := time.Now()
+
+        for {
+            select {
+            case <-stopCh:
+                return
+            case now := <-ticker.C:
+                snap := stats.snapshot()
+                elapsed := now.Sub(lastTick).Seconds()
+
+                deltaCompleted := snap.completed - lastCompleted
+                deltaErrors := snap.errors - lastErrors
+                deltaTokens := snap.totalTokens - lastTokens
+                deltaBytes := snap.totalBytes - lastBytes
+                p95 := computeLatencyStats(snap.latencies).p95
+
+                fmt.Printf("[live] completed=%d req/s=%.2f tok/s=%s bytes/s=%s/s p95=%v errors=%d\n",
+                    deltaCompleted,
+                    float64(deltaCompleted)/elapsed,
+                    humanize.SIWithDigits(float64(deltaTokens)/elapsed, 1, "tok/s"),
+                    humanize.Bytes(uint64(float64(deltaBytes)/elapsed)),
+                    p95,
+                    deltaErrors)
+
+                lastCompleted, lastErrors, lastTokens, lastBytes = snap.completed, snap.errors, snap.totalTokens, snap.totalBytes
+                lastTick = now
+            }
+        }
+    }()
+
+    return func() {
+        close(stopCh)
+        <-done
+    }
 }
 
 func readPromptsFromFile(filename string) ([]string, error) {
@@ -60,142 +1240,334 @@ func readPromptsFromFile(filename string) ([]string, error) {
     if err != nil {
         return nil, fmt.Errorf("error reading file: %v", err)
     }
-    
+
     var prompts []string
     for _, line := range strings.Split(string(content), "\n") {
         if trimmed := strings.TrimSpace(line); trimmed != "" {
             prompts = append(prompts, trimmed)
         }
     }
-    
+
     if len(prompts) == 0 {
         return nil, fmt.Errorf("no prompts found in file")
     }
-    
+
     return prompts, nil
 }
 
 func makeRequest(config RequestConfig, results chan<- Result) {
-    reqBody := RequestBody{
-        Messages: []Message{
-            {
-                Role:    "user",
-                Content: config.Prompt,
-            },
-        },
-        Model:     "meta/llama2-13b-chat-v1",
-        MaxTokens: config.MaxTokens,
-        TopP:      1,
-        N:         1,
-        Stream:    false,
+    if config.Stream {
+        makeStreamingRequest(config, results)
+        return
     }
-    
-    jsonData, err := json.Marshal(reqBody)
+
+    req, err := config.Backend.BuildRequest(config.Prompt, config.MaxTokens)
     if err != nil {
-        results <- Result{duration: 0, totalTokens: 0, err: fmt.Errorf("error marshaling JSON: %v", err)}
+        liveStats.recordError()
+        results <- Result{duration: 0, totalTokens: 0, err: err}
         return
     }
 
     client := &http.Client{
         Timeout: 60 * time.Second, // Increased timeout to 60 seconds
     }
-    
-    req, err := http.NewRequest("POST", config.URL, bytes.NewBuffer(jsonData))
-    if err != nil {
-        results <- Result{duration: 0, totalTokens: 0, err: fmt.Errorf("error creating request: %v", err)}
-        return
-    }
 
-    req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("Accept", "application/json")
-    
     start := time.Now()
-    
+
     resp, err := client.Do(req)
     if err != nil {
+        liveStats.recordError()
         results <- Result{duration: 0, totalTokens: 0, err: fmt.Errorf("error making request: %v", err)}
         return
     }
     defer resp.Body.Close()
-    
+
     body, err := ioutil.ReadAll(resp.Body)
     duration := time.Since(start)
-    
+
     if err != nil {
+        liveStats.recordError()
         results <- Result{duration: 0, totalTokens: 0, err: fmt.Errorf("error reading response: %v", err)}
         return
     }
 
     if resp.StatusCode != http.StatusOK {
-        results <- Result{duration: 0, totalTokens: 0, err: fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))}
+        liveStats.recordError()
+        results <- Result{duration: 0, totalTokens: 0, statusCode: resp.StatusCode, err: fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))}
+        return
+    }
+
+    promptTokens, completionTokens, err := config.Backend.ParseResponse(body)
+    if err != nil {
+        liveStats.recordError()
+        results <- Result{duration: 0, totalTokens: 0, statusCode: resp.StatusCode, err: err}
+        return
+    }
+    totalTokens := promptTokens + completionTokens
+
+    fmt.Printf("Request completed - Duration: %v, Tokens: %d\n",
+        duration, totalTokens)
+
+    liveStats.recordSuccess(duration, totalTokens, len(body))
+
+    results <- Result{
+        duration:     duration,
+        promptTokens: promptTokens,
+        totalTokens:  totalTokens,
+        statusCode:   resp.StatusCode,
+        err:          nil,
+    }
+}
+
+// makeStreamingRequest issues the configured backend's streaming request and
+// incrementally parses the `data: {...}` SSE chunks as they arrive,
+// recording time-to-first-token and the inter-token latency distribution
+// instead of only the end-to-end duration.
+func makeStreamingRequest(config RequestConfig, results chan<- Result) {
+    req, err := config.Backend.BuildStreamingRequest(config.Prompt, config.MaxTokens)
+    if err != nil {
+        liveStats.recordError()
+        results <- Result{err: err, streaming: true}
+        return
+    }
+
+    client := &http.Client{
+        Timeout: 60 * time.Second,
+    }
+
+    start := time.Now()
+
+    resp, err := client.Do(req)
+    if err != nil {
+        liveStats.recordError()
+        results <- Result{err: fmt.Errorf("error making request: %v", err), streaming: true}
+        return
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        body, _ := ioutil.ReadAll(resp.Body)
+        liveStats.recordError()
+        results <- Result{err: fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body)), streaming: true, statusCode: resp.StatusCode}
+        return
+    }
+
+    var ttft time.Duration
+    var lastTokenAt time.Time
+    var interTokenLatencies []time.Duration
+    var tokensOut int
+    var promptTokens int
+    var completionTokens int
+    var totalBytes int
+
+    scanner := bufio.NewScanner(resp.Body)
+    for scanner.Scan() {
+        totalBytes += len(scanner.Bytes()) + 1 // +1 for the newline the scanner strips
+        line := strings.TrimSpace(scanner.Text())
+
+        var payload string
+        switch {
+        case strings.HasPrefix(line, "data: "):
+            payload = strings.TrimPrefix(line, "data: ")
+        case strings.HasPrefix(line, "data:"):
+            // TGI emits the SSE prefix without a trailing space.
+            payload = strings.TrimPrefix(line, "data:")
+        default:
+            continue
+        }
+
+        content, chunkPromptTokens, chunkCompletionTokens, done, err := config.Backend.ParseStreamChunk([]byte(payload))
+        if err != nil {
+            continue
+        }
+        if chunkPromptTokens > 0 {
+            promptTokens = chunkPromptTokens
+        }
+        if chunkCompletionTokens > 0 {
+            completionTokens = chunkCompletionTokens
+        }
+
+        // Record this chunk's content before acting on done: some backends
+        // (e.g. TGI) deliver the final token's text together with the
+        // done sentinel on the same event, so checking done first would
+        // drop it from tokensOut and the latency samples.
+        if content != "" {
+            now := time.Now()
+            if tokensOut == 0 {
+                ttft = now.Sub(start)
+            } else {
+                interTokenLatencies = append(interTokenLatencies, now.Sub(lastTokenAt))
+            }
+            lastTokenAt = now
+            tokensOut++
+        }
+
+        if done {
+            break
+        }
+    }
+
+    duration := time.Since(start)
+
+    if err := scanner.Err(); err != nil {
+        liveStats.recordError()
+        results <- Result{err: fmt.Errorf("error reading stream: %v", err), streaming: true}
         return
     }
 
-    var responseBody ResponseBody
-    if err := json.Unmarshal(body, &responseBody); err != nil {
-        results <- Result{duration: 0, totalTokens: 0, err: fmt.Errorf("error parsing response JSON: %v", err)}
+    if tokensOut == 0 {
+        liveStats.recordError()
+        results <- Result{err: fmt.Errorf("no content received from stream"), streaming: true}
         return
     }
 
-    fmt.Printf("Request completed - Duration: %v, Tokens: %d\n", 
-        duration, responseBody.Usage.TotalTokens)
-    
+    if completionTokens == 0 {
+        completionTokens = tokensOut
+    }
+    totalTokens := promptTokens + completionTokens
+
+    var decodeTokensPerSec float64
+    if decodeDuration := duration - ttft; decodeDuration > 0 && tokensOut > 1 {
+        decodeTokensPerSec = float64(tokensOut-1) / decodeDuration.Seconds()
+    }
+
+    fmt.Printf("Streaming request completed - Duration: %v, TTFT: %v, Tokens: %d, Decode: %.2f tok/s\n",
+        duration, ttft, totalTokens, decodeTokensPerSec)
+
+    liveStats.recordSuccess(duration, totalTokens, totalBytes)
+
     results <- Result{
-        duration:    duration,
-        totalTokens: responseBody.Usage.TotalTokens,
-        err:        nil,
+        duration:            duration,
+        promptTokens:        promptTokens,
+        totalTokens:         totalTokens,
+        streaming:           true,
+        ttft:                ttft,
+        interTokenLatencies: interTokenLatencies,
+        decodeTokensPerSec:  decodeTokensPerSec,
+        statusCode:          resp.StatusCode,
     }
 }
 
-func calculateAverageResponseTime(config RequestConfig, numRequests int) (time.Duration, float64, int, error) {
+func calculateAverageResponseTime(config RequestConfig, numRequests int, loadGen LoadGenConfig, sampler *SystemSampler) ([]RequestRecord, PromptStats, error) {
     results := make(chan Result, numRequests)
-    
-    for i := 0; i < numRequests; i++ {
-        go makeRequest(config, results)
-        time.Sleep(500 * time.Millisecond)
+
+    var actualDuration time.Duration
+    if loadGen.qps > 0 {
+        actualDuration = runOpenLoop(config, numRequests, loadGen.qps, results)
+    } else {
+        runClosedLoop(config, numRequests, loadGen.concurrency, results)
     }
-    
-    var totalDuration time.Duration
+
+    var durations []time.Duration
     var totalTokens int
     var successfulRequests int
     var errors []error
-    
+
+    var totalTTFT time.Duration
+    var totalInterTokenLatency time.Duration
+    var interTokenSamples int
+    var totalDecodeTokensPerSec float64
+    var streamingRequests int
+    var totalQueueWait time.Duration
+
+    promptHash := hashPrompt(config.Prompt)
+    records := make([]RequestRecord, 0, numRequests)
+
     for i := 0; i < numRequests; i++ {
         result := <-results
+
+        record := RequestRecord{
+            Timestamp:        result.completedAt,
+            PromptIndex:      config.PromptIndex,
+            PromptHash:       promptHash,
+            Backend:          config.BackendName,
+            Model:            config.Model,
+            StatusCode:       result.statusCode,
+            DurationMs:       float64(result.duration) / float64(time.Millisecond),
+            TTFTMs:           float64(result.ttft) / float64(time.Millisecond),
+            PromptTokens:     result.promptTokens,
+            CompletionTokens: result.totalTokens - result.promptTokens,
+        }
+        if sampler != nil {
+            if sample, ok := sampler.nearestSample(record.Timestamp); ok {
+                record.Load1 = sample.load1
+                record.CPUPercent = sample.cpuPercent
+                record.MemUsedPercent = sample.memUsedPercent
+            }
+        }
+        if result.streaming {
+            record.DecodeMs = float64(result.duration-result.ttft) / float64(time.Millisecond)
+        }
+        if result.err != nil {
+            record.Error = result.err.Error()
+        }
+        records = append(records, record)
+
         if result.err != nil {
             fmt.Printf("Request error: %v\n", result.err)
             errors = append(errors, result.err)
             continue
         }
-        totalDuration += result.duration
+        durations = append(durations, result.duration)
         totalTokens += result.totalTokens
         successfulRequests++
-        
-        fmt.Printf("Request %d/%d - Duration: %v, Tokens: %d\n", 
-            i+1, numRequests, result.duration, result.totalTokens)
+        totalQueueWait += result.queueWait
+
+        fmt.Printf("Request %d/%d - Duration: %v, Queue Wait: %v, Tokens: %d\n",
+            i+1, numRequests, result.duration, result.queueWait, result.totalTokens)
+
+        if result.streaming {
+            streamingRequests++
+            totalTTFT += result.ttft
+            totalDecodeTokensPerSec += result.decodeTokensPerSec
+            for _, latency := range result.interTokenLatencies {
+                totalInterTokenLatency += latency
+                interTokenSamples++
+            }
+        }
     }
-    
+
     if successfulRequests == 0 {
-        return 0, 0, 0, fmt.Errorf("no successful requests (HTTP 200). Errors: %v", errors)
+        return records, PromptStats{}, fmt.Errorf("no successful requests (HTTP 200). Errors: %v", errors)
+    }
+
+    var streamStats StreamStats
+    if streamingRequests > 0 {
+        streamStats.avgTTFT = totalTTFT / time.Duration(streamingRequests)
+        streamStats.avgDecodeTokensPerSec = totalDecodeTokensPerSec / float64(streamingRequests)
+        if interTokenSamples > 0 {
+            streamStats.avgInterTokenLatency = totalInterTokenLatency / time.Duration(interTokenSamples)
+        }
+    }
+
+    promptStats := PromptStats{
+        durations:    durations,
+        totalTokens:  totalTokens,
+        successful:   successfulRequests,
+        streamStats:  streamStats,
+        avgQueueWait: totalQueueWait / time.Duration(successfulRequests),
+    }
+
+    if loadGen.qps > 0 {
+        promptStats.targetQPS = loadGen.qps
+        promptStats.achievedQPS = float64(numRequests) / actualDuration.Seconds()
+        promptStats.openLoopTime = actualDuration
     }
-    
-    avgDuration := totalDuration / time.Duration(successfulRequests)
-    tokensPerSecond := float64(totalTokens) / totalDuration.Seconds()
-    
-    return avgDuration, tokensPerSecond, successfulRequests, nil
+
+    return records, promptStats, nil
 }
 
 func warmup(config RequestConfig, numWarmupRequests int) error {
     fmt.Printf("\n=== Warming up with %d requests ===\n", numWarmupRequests)
     results := make(chan Result, numWarmupRequests)
-    
+
     for i := 0; i < numWarmupRequests; i++ {
         go makeRequest(config, results)
         time.Sleep(500 * time.Millisecond)
-        
+
         fmt.Printf("Warmup request %d/%d completed\n", i+1, numWarmupRequests)
     }
-    
+
     var successfulWarmups int
     for i := 0; i < numWarmupRequests; i++ {
         result := <-results
@@ -205,12 +1577,12 @@ func warmup(config RequestConfig, numWarmupRequests int) error {
         }
         successfulWarmups++
     }
-    
+
     if successfulWarmups == 0 {
         return fmt.Errorf("all warmup requests failed")
     }
-    
-    fmt.Printf("Warmup completed successfully with %d/%d requests\n", 
+
+    fmt.Printf("Warmup completed successfully with %d/%d requests\n",
         successfulWarmups, numWarmupRequests)
     return nil
 }
@@ -224,9 +1596,25 @@ func main() {
         return
     }
 
+    backendName := os.Getenv("BACKEND")
+    if backendName == "" {
+        backendName = "openai-chat"
+    }
+
     url := os.Getenv("URL")
     if url == "" {
-        url = "http://localhost:8000/v1/chat/completions"
+        url = defaultURLForBackend(backendName)
+    }
+
+    model := os.Getenv("MODEL")
+    if model == "" {
+        model = "meta/llama2-13b-chat-v1"
+    }
+
+    backend, err := newBackend(backendName, url, model)
+    if err != nil {
+        fmt.Printf("Error configuring backend: %v\n", err)
+        return
     }
 
     requestsPerPrompt := 10
@@ -243,30 +1631,83 @@ func main() {
         }
     }
 
+    streamMode := false
+    if envVal := os.Getenv("STREAM"); envVal != "" {
+        if val, err := strconv.ParseBool(envVal); err == nil {
+            streamMode = val
+        }
+    }
+
     warmupConfig := RequestConfig{
-        URL:       url,
+        Backend:   backend,
         Prompt:    prompts[0],
         MaxTokens: 200,
+        Stream:    streamMode,
     }
-    
+
+    loadGen := resolveLoadGenConfig(requestsPerPrompt)
+
     fmt.Printf("\n=== Benchmark Configuration ===\n")
     fmt.Printf("URL: %s\n", url)
+    fmt.Printf("Backend: %s\n", backendName)
+    fmt.Printf("Model: %s\n", model)
     fmt.Printf("Number of prompts: %d\n", len(prompts))
     fmt.Printf("Requests per prompt: %d\n", requestsPerPrompt)
     fmt.Printf("Warmup requests: %d\n", numWarmupRequests)
+    fmt.Printf("Streaming mode: %v\n", streamMode)
+    if loadGen.qps > 0 {
+        fmt.Printf("Load generation: open-loop, target %.2f QPS\n", loadGen.qps)
+    } else {
+        fmt.Printf("Load generation: closed-loop, concurrency %d\n", loadGen.concurrency)
+    }
     fmt.Printf("Total requests planned: %d\n", len(prompts)*requestsPerPrompt+numWarmupRequests)
-    
+
     if err := warmup(warmupConfig, numWarmupRequests); err != nil {
         fmt.Printf("Warmup failed: %v\n", err)
         return
     }
-    
+
+    // Snapshot (and drain) liveStats right after warmup so the live
+    // reporter's first window doesn't count warmup's requests/errors/tokens
+    // or leak its latencies into that window's p95.
+    liveStatsBaseline := liveStats.snapshot()
+
+    gpuMetrics := false
+    if envVal := os.Getenv("GPU_METRICS"); envVal != "" {
+        if val, err := strconv.ParseBool(envVal); err == nil {
+            gpuMetrics = val
+        }
+    }
+    targetMetricsURL := os.Getenv("TARGET_METRICS_URL")
+    if targetMetricsURL != "" {
+        fmt.Printf("Target metrics URL: %s\n", targetMetricsURL)
+    }
+
+    sampler := newSystemSampler(gpuMetrics, targetMetricsURL)
+    sampler.start(time.Second)
+
+    reportInterval := 10 * time.Second
+    if envVal := os.Getenv("REPORT_INTERVAL"); envVal != "" {
+        if val, err := strconv.Atoi(envVal); err == nil && val > 0 {
+            reportInterval = time.Duration(val) * time.Second
+        }
+    }
+    stopLiveReporter := startLiveReporter(liveStats, reportInterval, liveStatsBaseline)
+
     fmt.Println("\nWaiting 2 seconds before starting benchmark...")
     time.Sleep(2 * time.Second)
 
     var totalSuccessfulRequests int
-    var overallTotalDuration time.Duration
+    var overallDurations []time.Duration
     var overallTotalTokens int
+    var overallTotalDuration time.Duration
+    var overallOpenLoopRequests int
+    var overallOpenLoopTime time.Duration
+    var overallTTFT time.Duration
+    var overallInterTokenLatency time.Duration
+    var overallDecodeTokensPerSec float64
+    var promptsWithStreaming int
+    var allRecords []RequestRecord
     totalPlannedRequests := len(prompts) * requestsPerPrompt
 
     fmt.Printf("\n=== Starting Benchmark Test ===\n")
@@ -274,37 +1715,75 @@ func main() {
 
     for i, prompt := range prompts {
         config := RequestConfig{
-            URL:       url,
-            Prompt:    prompt,
-            MaxTokens: 200,
+            Backend:     backend,
+            BackendName: backendName,
+            Model:       model,
+            PromptIndex: i,
+            Prompt:      prompt,
+            MaxTokens:   200,
+            Stream:      streamMode,
         }
-        
+
         fmt.Printf("\n--- Prompt %d/%d ---\n", i+1, len(prompts))
         fmt.Printf("Prompt: %s\n", prompt)
-            
-        avgTime, tokensPerSec, successfulRequestsForPrompt, err := calculateAverageResponseTime(config, requestsPerPrompt)
+
+        records, promptStats, err := calculateAverageResponseTime(config, requestsPerPrompt, loadGen, sampler)
+        allRecords = append(allRecords, records...)
         if err != nil {
             fmt.Printf("Error calculating average: %v\n", err)
             continue
         }
 
-        promptTotalDuration := avgTime * time.Duration(successfulRequestsForPrompt)
-        promptTotalTokens := int(tokensPerSec * avgTime.Seconds()) * successfulRequestsForPrompt
-        
+        var promptTotalDuration time.Duration
+        for _, d := range promptStats.durations {
+            promptTotalDuration += d
+        }
+        tokensPerSec := float64(promptStats.totalTokens) / promptTotalDuration.Seconds()
+        latencyStats := computeLatencyStats(promptStats.durations)
+
+        overallDurations = append(overallDurations, promptStats.durations...)
+        overallTotalTokens += promptStats.totalTokens
         overallTotalDuration += promptTotalDuration
-        overallTotalTokens += promptTotalTokens
-        totalSuccessfulRequests += successfulRequestsForPrompt
-        
-        fmt.Printf("Prompt Average Response Time: %v\n", avgTime)
+        totalSuccessfulRequests += promptStats.successful
+        if promptStats.openLoopTime > 0 {
+            overallOpenLoopRequests += promptStats.successful
+            overallOpenLoopTime += promptStats.openLoopTime
+        }
+
+        fmt.Printf("Prompt Latency p50/p90/p95/p99: %v / %v / %v / %v\n",
+            latencyStats.p50, latencyStats.p90, latencyStats.p95, latencyStats.p99)
+        fmt.Printf("Prompt Latency min/max: %v / %v\n", latencyStats.min, latencyStats.max)
         fmt.Printf("Prompt Tokens per Second: %.2f\n", tokensPerSec)
-        fmt.Printf("Successful Requests for this prompt: %d/%d\n\n", successfulRequestsForPrompt, requestsPerPrompt)
+        fmt.Printf("Successful Requests for this prompt: %d/%d\n", promptStats.successful, requestsPerPrompt)
+        fmt.Printf("Prompt Avg Queue Wait: %v\n", promptStats.avgQueueWait)
+        if promptStats.targetQPS > 0 {
+            fmt.Printf("Prompt Target/Achieved QPS: %.2f / %.2f\n", promptStats.targetQPS, promptStats.achievedQPS)
+        }
+
+        if streamMode && promptStats.streamStats.avgTTFT > 0 {
+            fmt.Printf("Prompt Avg TTFT: %v\n", promptStats.streamStats.avgTTFT)
+            fmt.Printf("Prompt Avg Inter-Token Latency: %v\n", promptStats.streamStats.avgInterTokenLatency)
+            fmt.Printf("Prompt Avg Decode Throughput: %.2f tok/s\n\n", promptStats.streamStats.avgDecodeTokensPerSec)
+
+            overallTTFT += promptStats.streamStats.avgTTFT
+            overallInterTokenLatency += promptStats.streamStats.avgInterTokenLatency
+            overallDecodeTokensPerSec += promptStats.streamStats.avgDecodeTokensPerSec
+            promptsWithStreaming++
+        } else {
+            fmt.Println()
+        }
     }
 
+    stopLiveReporter()
+    sampler.stopAndWait()
+
     totalBenchmarkDuration := time.Since(benchmarkStart)
 
+    var overallLatencyStats LatencyStats
+    var overallTokensPerSec float64
     if totalSuccessfulRequests > 0 {
-        overallAvgLatency := overallTotalDuration / time.Duration(totalSuccessfulRequests)
-        overallTokensPerSec := float64(overallTotalTokens) / overallTotalDuration.Seconds()
+        overallLatencyStats = computeLatencyStats(overallDurations)
+        overallTokensPerSec = float64(overallTotalTokens) / overallTotalDuration.Seconds()
 
         fmt.Printf("\n=== Overall Benchmark Results ===\n")
         fmt.Printf("End time: %v\n", time.Now().Format("2006-01-02 15:04:05"))
@@ -312,16 +1791,77 @@ func main() {
         fmt.Printf("Total Successful Requests (HTTP 200): %d\n", totalSuccessfulRequests)
         fmt.Printf("Failed Requests: %d\n", totalPlannedRequests-totalSuccessfulRequests)
         fmt.Printf("Success Rate: %.2f%%\n", float64(totalSuccessfulRequests)/float64(totalPlannedRequests)*100)
-        fmt.Printf("Overall Average Latency: %v\n", overallAvgLatency)
+        fmt.Printf("Overall Latency p50/p90/p95/p99: %v / %v / %v / %v\n",
+            overallLatencyStats.p50, overallLatencyStats.p90, overallLatencyStats.p95, overallLatencyStats.p99)
+        fmt.Printf("Overall Latency min/max: %v / %v\n", overallLatencyStats.min, overallLatencyStats.max)
         fmt.Printf("Overall Average Tokens/Second: %.2f\n", overallTokensPerSec)
-        
+
         fmt.Printf("\n=== Timing Breakdown ===\n")
         fmt.Printf("Total wall clock time: %v\n", totalBenchmarkDuration)
         fmt.Printf("Total processing time: %v\n", overallTotalDuration)
-        fmt.Printf("Overhead time (includes delays): %v\n", 
+        fmt.Printf("Overhead time (includes delays): %v\n",
             totalBenchmarkDuration-overallTotalDuration)
+
+        if streamMode && promptsWithStreaming > 0 {
+            fmt.Printf("\n=== Streaming Metrics ===\n")
+            fmt.Printf("Overall Average TTFT: %v\n", overallTTFT/time.Duration(promptsWithStreaming))
+            fmt.Printf("Overall Average Inter-Token Latency: %v\n", overallInterTokenLatency/time.Duration(promptsWithStreaming))
+            fmt.Printf("Overall Average Decode Throughput: %.2f tok/s\n", overallDecodeTokensPerSec/float64(promptsWithStreaming))
+        }
+
+        printSystemMetrics(sampler)
     } else {
         fmt.Printf("\n=== Benchmark Failed ===\n")
         fmt.Printf("No successful requests completed (HTTP 200)\n")
     }
+
+    outJSON := os.Getenv("OUT_JSON")
+    outCSV := os.Getenv("OUT_CSV")
+
+    if outJSON != "" {
+        if err := writeJSONRecords(outJSON, allRecords); err != nil {
+            fmt.Printf("Error writing %s: %v\n", outJSON, err)
+        } else {
+            fmt.Printf("Wrote %d request records to %s\n", len(allRecords), outJSON)
+        }
+    }
+
+    if outCSV != "" {
+        if err := writeCSVRecords(outCSV, allRecords); err != nil {
+            fmt.Printf("Error writing %s: %v\n", outCSV, err)
+        } else {
+            fmt.Printf("Wrote %d request records to %s\n", len(allRecords), outCSV)
+        }
+    }
+
+    if outJSON != "" || outCSV != "" {
+        summaryPath := os.Getenv("SUMMARY_JSON")
+        if summaryPath == "" {
+            summaryPath = "summary.json"
+        }
+
+        summary := RunSummary{
+            TotalRequests:      totalPlannedRequests,
+            SuccessfulRequests: totalSuccessfulRequests,
+            SuccessRatePct:     float64(totalSuccessfulRequests) / float64(totalPlannedRequests) * 100,
+            LatencyP50Ms:       float64(overallLatencyStats.p50) / float64(time.Millisecond),
+            LatencyP90Ms:       float64(overallLatencyStats.p90) / float64(time.Millisecond),
+            LatencyP95Ms:       float64(overallLatencyStats.p95) / float64(time.Millisecond),
+            LatencyP99Ms:       float64(overallLatencyStats.p99) / float64(time.Millisecond),
+            LatencyMinMs:       float64(overallLatencyStats.min) / float64(time.Millisecond),
+            LatencyMaxMs:       float64(overallLatencyStats.max) / float64(time.Millisecond),
+            TokensPerSecond:    overallTokensPerSec,
+            TargetQPS:          loadGen.qps,
+            SystemMetrics:      buildSystemMetricsSummary(sampler),
+        }
+        if overallOpenLoopTime > 0 {
+            summary.AchievedQPS = float64(overallOpenLoopRequests) / overallOpenLoopTime.Seconds()
+        }
+
+        if err := writeSummaryJSON(summaryPath, summary); err != nil {
+            fmt.Printf("Error writing %s: %v\n", summaryPath, err)
+        } else {
+            fmt.Printf("Wrote run summary to %s\n", summaryPath)
+        }
+    }
 }